@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	icecastListeners, icecastListenerPeak       *prometheus.GaugeVec
+	icecastSourceConnected, icecastSourceUptime *prometheus.GaugeVec
+)
+
+func initIcecastMetrics(namespace string) {
+	icecastListeners = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "icecast_listeners",
+			Help:      "Current number of listeners of the Icecast mount",
+		},
+		[]string{"mount"},
+	)
+	icecastListenerPeak = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "icecast_listener_peak",
+			Help:      "Peak number of listeners of the Icecast mount",
+		},
+		[]string{"mount"},
+	)
+	icecastSourceConnected = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "icecast_source_connected",
+			Help:      "1 if a source client is connected to the Icecast mount, 0 if the mount is there without one or went away",
+		},
+		[]string{"mount"},
+	)
+	icecastSourceUptime = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "icecast_source_uptime_seconds",
+			Help:      "Seconds since the source client of the Icecast mount connected",
+		},
+		[]string{"mount"},
+	)
+}
+
+// icecastSource is a mount as reported by Icecast's status-json.xsl
+type icecastSource struct {
+	ListenURL    string  `json:"listenurl"`
+	Listeners    float64 `json:"listeners"`
+	ListenerPeak float64 `json:"listener_peak"`
+	// Only reported by some Icecast versions and forks, as a boolean, a
+	// number or a string
+	SourceConnected any `json:"source_connected"`
+	// When the source connected, e.g. "Mon, 14 Oct 2024 12:00:00 +0200"
+	StreamStart        string `json:"stream_start"`
+	StreamStartISO8601 string `json:"stream_start_iso8601"`
+}
+
+type icecastStatus struct {
+	Icestats struct {
+		// A single object when the server has one mount, an array otherwise
+		Source json.RawMessage `json:"source"`
+	} `json:"icestats"`
+}
+
+// sources returns the mounts of the status, whichever shape Icecast used.
+func (st icecastStatus) sources() ([]icecastSource, error) {
+	raw := st.Icestats.Source
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var list []icecastSource
+	if err := json.Unmarshal(raw, &list); err == nil {
+		return list, nil
+	}
+	var one icecastSource
+	if err := json.Unmarshal(raw, &one); err != nil {
+		return nil, err
+	}
+	return []icecastSource{one}, nil
+}
+
+// mount returns the mount point of a source, e.g. "/radio.mp3".
+func (src icecastSource) mount() string {
+	if u, err := url.Parse(src.ListenURL); err == nil && u.Path != "" {
+		return u.Path
+	}
+	return src.ListenURL
+}
+
+// connected tells whether a source client is connected to the mount: as
+// reported by source_connected if present, otherwise by the presence of
+// its start time.
+func (src icecastSource) connected() bool {
+	switch v := src.SourceConnected.(type) {
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return v == "1" || strings.EqualFold(v, "true")
+	}
+	return src.StreamStart != "" || src.StreamStartISO8601 != ""
+}
+
+// started returns when the source client connected, if known.
+func (src icecastSource) started() (time.Time, bool) {
+	if t, err := time.Parse("2006-01-02T15:04:05-0700", src.StreamStartISO8601); err == nil {
+		return t, true
+	}
+	if t, err := time.Parse(time.RFC1123Z, src.StreamStart); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// fetchIcecastStatus gets the status of the configured Icecast server.
+func fetchIcecastStatus(ctx context.Context, cfg Config) (icecastStatus, error) {
+	var st icecastStatus
+	endpoint := strings.TrimSuffix(cfg.IcecastAdminURL, "/") + "/status-json.xsl"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return st, err
+	}
+	if cfg.IcecastAdminUser != "" {
+		req.SetBasicAuth(cfg.IcecastAdminUser, cfg.IcecastAdminPassword)
+	}
+	client := &http.Client{Timeout: seconds(cfg.ProbeTimeoutSeconds)}
+	resp, err := client.Do(req)
+	if err != nil {
+		return st, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return st, fmt.Errorf("%s returned %s", sanitizeURL(endpoint), resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&st)
+	return st, err
+}
+
+// icecastMounts remembers when each mount was last seen, so that the series
+// of mounts that went away can be dropped. Their icecast_source_connected is
+// kept at 0 for icecastMountGrace probe intervals instead, as the mount of a
+// source that disconnected usually goes away with it, then deleted too so
+// that renamed or retired mounts don't pile up.
+var (
+	icecastMu     sync.Mutex
+	icecastMounts = make(map[string]time.Time)
+)
+
+const icecastMountGrace = 10
+
+// scrapeIcecast updates the listener metrics from the Icecast server.
+func scrapeIcecast(ctx context.Context, cfg Config) {
+	st, err := fetchIcecastStatus(ctx, cfg)
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.Warn("Icecast stats scrape failed", "url", sanitizeURL(cfg.IcecastAdminURL), "err", err)
+		}
+		return
+	}
+	sources, err := st.sources()
+	if err != nil {
+		slog.Warn("Icecast stats parsing failed", "url", sanitizeURL(cfg.IcecastAdminURL), "err", err)
+		return
+	}
+
+	icecastMu.Lock()
+	defer icecastMu.Unlock()
+	now := time.Now()
+	seen := make(map[string]bool, len(sources))
+	for _, src := range sources {
+		mount := src.mount()
+		seen[mount] = true
+		icecastMounts[mount] = now
+		icecastListeners.WithLabelValues(mount).Set(src.Listeners)
+		icecastListenerPeak.WithLabelValues(mount).Set(src.ListenerPeak)
+		connected := src.connected()
+		start, ok := src.started()
+		if connected && ok {
+			icecastSourceUptime.WithLabelValues(mount).Set(now.Sub(start).Seconds())
+		} else {
+			icecastSourceUptime.DeleteLabelValues(mount)
+		}
+		if connected {
+			icecastSourceConnected.WithLabelValues(mount).Set(1)
+		} else {
+			icecastSourceConnected.WithLabelValues(mount).Set(0)
+		}
+	}
+	grace := icecastMountGrace * seconds(cfg.ProbeIntervalSeconds)
+	for mount, last := range icecastMounts {
+		if seen[mount] {
+			continue
+		}
+		icecastListeners.DeleteLabelValues(mount)
+		icecastListenerPeak.DeleteLabelValues(mount)
+		icecastSourceUptime.DeleteLabelValues(mount)
+		if now.Sub(last) > grace {
+			icecastSourceConnected.DeleteLabelValues(mount)
+			delete(icecastMounts, mount)
+		} else {
+			icecastSourceConnected.WithLabelValues(mount).Set(0)
+		}
+	}
+}
+
+// runIcecastScraper scrapes the Icecast server every probe interval, when
+// icecast_admin_url is configured.
+func runIcecastScraper(ctx context.Context) {
+	for {
+		cfg := currentConfig()
+		if cfg.IcecastAdminURL != "" {
+			scrapeIcecast(ctx, cfg)
+		}
+		if !sleepCtx(ctx, seconds(cfg.ProbeIntervalSeconds)) {
+			return
+		}
+	}
+}
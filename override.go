@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var overrideActive *prometheus.GaugeVec
+
+// overrideMetrics are the metrics a test override can force, by the name
+// given to /admin/overrides
+var overrideMetrics = map[string]string{
+	"silence_active": "audio_silence_active",
+	"stream_up":      "audio_stream_up",
+}
+
+func initOverrideMetrics(namespace string) {
+	overrideActive = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "audio_test_override_active",
+			Help:      "1 while a test override forces the metric of the stream, set through /admin/overrides",
+		},
+		append(append([]string{}, streamLabels...), "metric"),
+	)
+	overrides.families = make(map[string]string, len(overrideMetrics))
+	for metric, name := range overrideMetrics {
+		overrides.families[prometheus.BuildFQName(namespace, "", name)] = metric
+	}
+}
+
+// testOverride forces a metric of a stream to a value until it expires.
+type testOverride struct {
+	Stream string    `json:"stream"` // name of the stream
+	Metric string    `json:"metric"`
+	Value  float64   `json:"value"`
+	Until  time.Time `json:"until"`
+	labels []string
+}
+
+// testOverrides are the overrides set through /admin/overrides, applied to
+// the gathered metrics rather than to the metrics themselves: the probes
+// and monitors keep running, and the actual values are back as soon as an
+// override expires.
+type testOverrides struct {
+	mu   sync.Mutex
+	list map[[2]string]testOverride // by sanitized URL and metric
+	// The names of the metrics of overrideMetrics once namespaced
+	families map[string]string
+}
+
+var overrides = &testOverrides{list: make(map[[2]string]testOverride)}
+
+// set forces the metric of s to v for d.
+func (o *testOverrides) set(s Stream, metric string, v float64, d time.Duration, now time.Time) testOverride {
+	ov := testOverride{Stream: s.Name, Metric: metric, Value: v, Until: now.Add(d), labels: s.labelValues()}
+	o.mu.Lock()
+	o.list[[2]string{ov.labels[0], metric}] = ov
+	o.mu.Unlock()
+	overrideActive.WithLabelValues(append(ov.labels, metric)...).Set(1)
+	time.AfterFunc(d, func() { o.active(time.Now()) })
+	return ov
+}
+
+// reset removes the overrides of s, of the given metric or of all if
+// empty, and returns how many.
+func (o *testOverrides) reset(s Stream, metric string) int {
+	url := s.labelValues()[0]
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	n := 0
+	for key, ov := range o.list {
+		if key[0] == url && (metric == "" || key[1] == metric) {
+			delete(o.list, key)
+			overrideActive.DeleteLabelValues(append(ov.labels, ov.Metric)...)
+			n++
+		}
+	}
+	return n
+}
+
+// active drops the overrides expired by now and returns the others.
+func (o *testOverrides) active(now time.Time) []testOverride {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	list := make([]testOverride, 0, len(o.list))
+	for key, ov := range o.list {
+		if !now.Before(ov.Until) {
+			delete(o.list, key)
+			overrideActive.DeleteLabelValues(append(ov.labels, ov.Metric)...)
+			slog.Info("Test override expired", "stream", ov.Stream, "metric", ov.Metric)
+			continue
+		}
+		list = append(list, ov)
+	}
+	slices.SortFunc(list, func(a, b testOverride) int { return a.Until.Compare(b.Until) })
+	return list
+}
+
+// gatherer applies the active overrides to the metrics gathered from g.
+func (o *testOverrides) gatherer(g prometheus.Gatherer) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := g.Gather()
+		list := o.active(time.Now())
+		if len(list) == 0 {
+			return families, err
+		}
+		forced := make(map[[2]string]float64, len(list))
+		for _, ov := range list {
+			forced[[2]string{ov.labels[0], ov.Metric}] = ov.Value
+		}
+		for _, mf := range families {
+			metric, ok := o.families[mf.GetName()]
+			if !ok {
+				continue
+			}
+			for _, m := range mf.GetMetric() {
+				for _, lp := range m.GetLabel() {
+					if lp.GetName() != "url" {
+						continue
+					}
+					if v, ok := forced[[2]string{lp.GetValue(), metric}]; ok && m.Gauge != nil {
+						m.Gauge.Value = &v
+					}
+				}
+			}
+		}
+		return families, err
+	})
+}
+
+// overridesHandler serves /admin/overrides: GET lists the active
+// overrides, POST sets one (stream, metric, value and seconds, as query or
+// form parameters) and DELETE removes those of a stream (stream, and
+// optionally metric).
+func overridesHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON := func(v any) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+	if r.Method == http.MethodGet {
+		writeJSON(overrides.active(time.Now()))
+		return
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cfg := currentConfig()
+	var (
+		s     Stream
+		found bool
+	)
+	id := r.FormValue("stream")
+	for _, cs := range cfg.Streams {
+		if cs.Name == id || streamID(cs.URL) == id {
+			s, found = cs, true
+			break
+		}
+	}
+	if !found {
+		http.Error(w, "Unknown stream", http.StatusNotFound)
+		return
+	}
+	metric := r.FormValue("metric")
+	if _, ok := overrideMetrics[metric]; !ok && (metric != "" || r.Method == http.MethodPost) {
+		http.Error(w, "Invalid metric (must be silence_active or stream_up)", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		n := overrides.reset(s, metric)
+		slog.Warn("Test overrides removed", "stream", s.Name, "metric", metric, "count", n)
+		writeJSON(map[string]int{"removed": n})
+		return
+	}
+	v, err := strconv.ParseFloat(r.FormValue("value"), 64)
+	if err != nil || (v != 0 && v != 1) {
+		http.Error(w, "Invalid value (must be 0 or 1)", http.StatusBadRequest)
+		return
+	}
+	secs, err := strconv.ParseFloat(r.FormValue("seconds"), 64)
+	if err != nil || secs <= 0 || secs > cfg.TestOverrideMaxSeconds {
+		http.Error(w, "Invalid seconds (must be above 0 and at most test_override_max_seconds)", http.StatusBadRequest)
+		return
+	}
+	ov := overrides.set(s, metric, v, seconds(secs), time.Now())
+	slog.Warn("Test override set", "stream", s.Name, "metric", metric, "value", v, "until", ov.Until)
+	writeJSON(ov)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var probeAgeDesc *prometheus.Desc
+
+func initPullMetrics(namespace string) {
+	probeAgeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "audio_stream_probe_age_seconds"),
+		"Seconds since the stream was last probed (only with scrape_mode: pull)",
+		streamLabels, nil,
+	)
+}
+
+// pullCollector exposes the probe metrics when scrape_mode is pull: instead
+// of probing in the background, the streams whose last probe is older than
+// their probe interval are probed when /metrics is scraped. The probes are
+// run by the handler rather than by Collect, so that gathering the metrics
+// for StatsD doesn't probe.
+type pullCollector struct {
+	// mu is held while probing, so that concurrent scrapes wait for the
+	// same probes rather than starting their own
+	mu        sync.Mutex
+	lastProbe map[string]time.Time // by stream URL
+}
+
+var pullProbes = &pullCollector{lastProbe: make(map[string]time.Time)}
+
+func (p *pullCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range probeMetrics {
+		c.Describe(ch)
+	}
+	ch <- probeAgeDesc
+}
+
+func (p *pullCollector) Collect(ch chan<- prometheus.Metric) {
+	cfg := currentConfig()
+	p.mu.Lock()
+	now := time.Now()
+	for _, s := range cfg.Streams {
+		if last, ok := p.lastProbe[s.URL]; ok {
+			ch <- prometheus.MustNewConstMetric(probeAgeDesc, prometheus.GaugeValue, now.Sub(last).Seconds(), s.labelValues()...)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, c := range probeMetrics {
+		c.Collect(ch)
+	}
+}
+
+// handler probes the streams that are due before next serves the metrics,
+// in pull mode. The probes are cancelled with ctx, and tracked by wg along
+// with the background ones.
+func (p *pullCollector) handler(ctx context.Context, wg *sync.WaitGroup, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		// Read once holding mu, a reload may have happened meanwhile
+		if cfg := currentConfig(); cfg.ScrapeMode == "pull" && cfg.probeEnabled() {
+			p.refresh(ctx, wg, cfg)
+		}
+		p.mu.Unlock()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// hold waits for the probes tracked by wg and keeps new probes on scrape
+// from starting until release is called, so that a reload or the shutdown
+// doesn't race them.
+func (p *pullCollector) hold(wg *sync.WaitGroup) (release func()) {
+	p.mu.Lock()
+	wg.Wait()
+	return p.mu.Unlock
+}
+
+// refresh probes the streams of cfg that are due, and waits for them.
+func (p *pullCollector) refresh(ctx context.Context, tracked *sync.WaitGroup, cfg Config) {
+	if ctx.Err() != nil {
+		// Shutting down
+		return
+	}
+	wanted := make(map[string]bool, len(cfg.Streams))
+	for _, s := range cfg.Streams {
+		wanted[s.URL] = true
+	}
+	for url := range p.lastProbe {
+		if !wanted[url] {
+			delete(p.lastProbe, url)
+		}
+	}
+
+	var (
+		wg     sync.WaitGroup
+		probed []string
+	)
+	now := time.Now()
+	for _, s := range cfg.Streams {
+		if last, ok := p.lastProbe[s.URL]; ok && now.Sub(last) < s.probeInterval() {
+			continue
+		}
+		sem, ok := probes.start(s.URL, cfg.MaxConcurrentProbes)
+		if !ok {
+			continue
+		}
+		probed = append(probed, s.URL)
+		wg.Add(1)
+		tracked.Add(1)
+		go func() {
+			defer tracked.Done()
+			defer wg.Done()
+			defer probes.done(s.URL)
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-sem }()
+			// Probes are bounded by probe_timeout_seconds, whether or not
+			// the scraper is still waiting
+			checkStream(ctx, s)
+		}()
+	}
+	wg.Wait()
+	for _, url := range probed {
+		p.lastProbe[url] = time.Now()
+	}
+}
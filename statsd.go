@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// statsdSettings are the settings a statsdPusher is created from, a change
+// of them on reload replaces it.
+type statsdSettings struct {
+	address string
+	prefix  string
+	tags    bool
+}
+
+func statsdSettingsFor(cfg Config) statsdSettings {
+	return statsdSettings{cfg.StatsDAddress, cfg.StatsDPrefix, cfg.StatsDTags}
+}
+
+// statsdMaxPacket keeps the datagrams under the usual MTU
+const statsdMaxPacket = 1432
+
+// statsdPusher sends the metrics gathered from the Prometheus registry as
+// StatsD gauges and counters over UDP. It's an exporter of what was
+// gathered, not another place the metrics are recorded: checkStream and
+// monitorAudio only update the Prometheus metrics. StatsD has no labels:
+// they are appended to the bucket name, or sent as DogStatsD tags with
+// statsd_tags.
+type statsdPusher struct {
+	conn   net.Conn
+	prefix string
+	tags   bool
+	// Counters are sent as increments, from the value of the previous push
+	counters map[string]float64
+}
+
+func newStatsDPusher(set statsdSettings) (*statsdPusher, error) {
+	conn, err := net.Dial("udp", set.address)
+	if err != nil {
+		return nil, err
+	}
+	return &statsdPusher{conn: conn, prefix: set.prefix, tags: set.tags, counters: make(map[string]float64)}, nil
+}
+
+func (s *statsdPusher) close() error {
+	return s.conn.Close()
+}
+
+func (s *statsdPusher) push(families []*dto.MetricFamily) error {
+	var (
+		packet []byte
+		errs   []error
+	)
+	send := func(line string) {
+		if len(packet) > 0 && len(packet)+1+len(line) > statsdMaxPacket {
+			if _, err := s.conn.Write(packet); err != nil {
+				errs = append(errs, err)
+			}
+			packet = packet[:0]
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	seen := make(map[string]bool, len(s.counters))
+	for _, mf := range families {
+		name := mf.GetName()
+		// The runtime metrics of the exporter itself aren't worth pushing
+		if strings.HasPrefix(name, "go_") || strings.HasPrefix(name, "process_") || strings.HasPrefix(name, "promhttp_") {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			switch mf.GetType() {
+			case dto.MetricType_GAUGE:
+				s.gauge(send, name, m.GetLabel(), m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				s.gauge(send, name, m.GetLabel(), m.GetUntyped().GetValue())
+			case dto.MetricType_COUNTER:
+				s.counter(send, seen, name, m.GetLabel(), m.GetCounter().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				s.counter(send, seen, name+"_count", m.GetLabel(), float64(h.GetSampleCount()))
+				s.counter(send, seen, name+"_sum", m.GetLabel(), h.GetSampleSum())
+			case dto.MetricType_SUMMARY:
+				sm := m.GetSummary()
+				s.counter(send, seen, name+"_count", m.GetLabel(), float64(sm.GetSampleCount()))
+				s.counter(send, seen, name+"_sum", m.GetLabel(), sm.GetSampleSum())
+			}
+		}
+	}
+	if len(packet) > 0 {
+		if _, err := s.conn.Write(packet); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	// Forget the series that went away, so that they start over from 0 if
+	// they come back
+	for key := range s.counters {
+		if !seen[key] {
+			delete(s.counters, key)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("sending to StatsD: %w", err)
+	}
+	return nil
+}
+
+func (s *statsdPusher) gauge(send func(string), name string, labels []*dto.LabelPair, v float64) {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return
+	}
+	bucket, tags := s.bucket(name, labels)
+	// A signed gauge value is taken as a change of the current one: a
+	// negative value is sent by setting the gauge to 0 first
+	if v < 0 {
+		send(bucket + ":0|g" + tags)
+	}
+	send(bucket + ":" + strconv.FormatFloat(v, 'g', -1, 64) + "|g" + tags)
+}
+
+func (s *statsdPusher) counter(send func(string), seen map[string]bool, name string, labels []*dto.LabelPair, v float64) {
+	bucket, tags := s.bucket(name, labels)
+	key := bucket + tags
+	seen[key] = true
+	delta := v - s.counters[key]
+	if delta < 0 {
+		// The counter was reset, e.g. its series deleted and recreated
+		delta = v
+	}
+	s.counters[key] = v
+	if delta == 0 || math.IsNaN(delta) || math.IsInf(delta, 0) {
+		return
+	}
+	send(bucket + ":" + strconv.FormatFloat(delta, 'g', -1, 64) + "|c" + tags)
+}
+
+// bucket returns the StatsD name of a series and its DogStatsD tags, if
+// any. Without tags, the label values are appended to the name, in the
+// order of the label names, e.g.
+// "prefix.audio_stream_up.group.name.http___host_mount".
+func (s *statsdPusher) bucket(name string, labels []*dto.LabelPair) (string, string) {
+	bucket := name
+	if s.prefix != "" {
+		bucket = s.prefix + "." + name
+	}
+	if s.tags {
+		if len(labels) == 0 {
+			return bucket, ""
+		}
+		tags := make([]string, 0, len(labels))
+		for _, lp := range labels {
+			tags = append(tags, lp.GetName()+":"+statsdTagReplacer.Replace(lp.GetValue()))
+		}
+		return bucket, "|#" + strings.Join(tags, ",")
+	}
+	for _, lp := range labels {
+		bucket += "." + statsdBucketPart(lp.GetValue())
+	}
+	return bucket, ""
+}
+
+// Characters with a meaning in the DogStatsD tags
+var statsdTagReplacer = strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_")
+
+// statsdBucketPart makes a label value fit in a bucket name, where dots
+// separate the parts and colons end the name.
+func statsdBucketPart(v string) string {
+	if v == "" {
+		return "none"
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, v)
+}
+
+// runStatsDPusher pushes the metrics gathered from g to statsd_address
+// every statsd_interval_seconds, if set. The pusher is replaced when a
+// reload changes its settings.
+func runStatsDPusher(ctx context.Context, g prometheus.Gatherer) {
+	var (
+		out     *statsdPusher
+		current statsdSettings
+	)
+	defer func() {
+		if out != nil {
+			out.close()
+		}
+	}()
+	for {
+		cfg := currentConfig()
+		if set := statsdSettingsFor(cfg); set != current || (out == nil && set.address != "") {
+			if out != nil {
+				out.close()
+				out = nil
+			}
+			current = set
+			if set.address != "" {
+				var err error
+				if out, err = newStatsDPusher(set); err != nil {
+					slog.Warn("StatsD setup failed", "address", set.address, "err", err)
+				}
+			}
+		}
+		if out != nil {
+			families, err := g.Gather()
+			if err != nil {
+				slog.Warn("Gathering the metrics for StatsD failed", "err", err)
+			}
+			if err := out.push(families); err != nil {
+				slog.Warn("Pushing the metrics to StatsD failed", "address", current.address, "err", err)
+			}
+		}
+		if !sleepCtx(ctx, seconds(cfg.StatsDIntervalSeconds)) {
+			return
+		}
+	}
+}